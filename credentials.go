@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Credential is a single identity a mob agent can authenticate with.
+type Credential struct {
+	Username   string `json:"username" yaml:"username"`
+	Password   string `json:"password" yaml:"password"`
+	Key        string `json:"key" yaml:"key"`
+	Passphrase string `json:"passphrase" yaml:"passphrase"`
+}
+
+// loadCredentials reads a YAML or JSON file containing a list of
+// credentials. JSON is attempted first since it's a strict subset of
+// YAML; if that fails we fall back to a YAML parse.
+func loadCredentials(path string) ([]Credential, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read credentials file: %s", err)
+	}
+
+	var creds []Credential
+	if err := json.Unmarshal(data, &creds); err != nil {
+		if yamlErr := yaml.Unmarshal(data, &creds); yamlErr != nil {
+			return nil, fmt.Errorf("Failed to parse credentials file as JSON or YAML: %s", yamlErr)
+		}
+	}
+
+	if len(creds) == 0 {
+		return nil, fmt.Errorf("Credentials file contains no entries: %s", path)
+	}
+
+	return creds, nil
+}
+
+// CredentialPool hands out credentials to spawned agents, either by
+// cycling through the list in order or by picking one at random, so a
+// mob can exercise many identities instead of N copies of the same login.
+type CredentialPool struct {
+	mu    sync.Mutex
+	creds []Credential
+	mode  string
+	next  int
+}
+
+// NewCredentialPool builds a pool from the given credentials using the
+// given selection mode ("round-robin" or "random"). Unknown modes fall
+// back to "round-robin".
+func NewCredentialPool(creds []Credential, mode string) *CredentialPool {
+	return &CredentialPool{
+		creds: creds,
+		mode:  mode,
+	}
+}
+
+// Next returns the next credential to use, according to the pool's mode.
+func (p *CredentialPool) Next() Credential {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.mode == "random" {
+		return p.creds[rand.Intn(len(p.creds))]
+	}
+
+	cred := p.creds[p.next%len(p.creds)]
+	p.next++
+
+	return cred
+}
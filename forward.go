@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// RunForwardLocalProgram opens a local listener and relays every
+// connection accepted on it to a.ForwardTargetAddr through the SSH
+// connection's direct-tcpip channel, the same mechanism "ssh -L" uses.
+// The agent then drives synthetic traffic through its own listener so a
+// mob run exercises the tunnel without needing an external client.
+func (a *Agent) RunForwardLocalProgram() error {
+	if a.Connection == nil {
+		return fmt.Errorf("Connection is nil")
+	}
+
+	if a.ForwardTargetAddr == "" {
+		return fmt.Errorf("-forward-target is required for -mode forward-local")
+	}
+
+	listener, err := net.Listen("tcp", a.ForwardListenAddr)
+	if err != nil {
+		return fmt.Errorf("Failed to open local listener: %s", err)
+	}
+
+	defer listener.Close()
+
+	log.Debug("Listening for local forward connections.", "addr", listener.Addr())
+
+	go a.acceptForward(listener, func() (net.Conn, error) {
+		return a.Connection.Dial("tcp", a.ForwardTargetAddr)
+	})
+
+	return a.driveForwardTraffic(listener.Addr().String())
+}
+
+// RunForwardRemoteProgram asks the SSH server to open a listener on its
+// side (the "tcpip-forward" request "ssh -R" makes) and relays every
+// channel it hands back to a.ForwardTargetAddr on this machine. Traffic
+// is driven by having the remote host pipe a payload into its own
+// forwarded port, since this process has no direct route to a listener
+// that only exists on the server.
+func (a *Agent) RunForwardRemoteProgram() error {
+	if a.Connection == nil {
+		return fmt.Errorf("Connection is nil")
+	}
+
+	if a.ForwardTargetAddr == "" {
+		return fmt.Errorf("-forward-target is required for -mode forward-remote")
+	}
+
+	listener, err := a.Connection.Listen("tcp", a.ForwardListenAddr)
+	if err != nil {
+		return fmt.Errorf("Failed to open remote listener: %s", err)
+	}
+
+	// listener is reassigned by reopen below, so this has to close
+	// whatever it holds when we return, not the one that existed at
+	// defer time.
+	defer func() { listener.Close() }()
+
+	log.Debug("Listening for remote forward connections.", "addr", listener.Addr())
+
+	go a.acceptForward(listener, func() (net.Conn, error) {
+		return net.Dial("tcp", a.ForwardTargetAddr)
+	})
+
+	// The "tcpip-forward" request is bound to the *ssh.Client it was
+	// made on, so a reconnect kills the forwarded port along with the
+	// dead connection it replaces. reopen re-asks the new connection
+	// for a listener and restarts the accept loop on it; addr reads
+	// back whatever address is currently live, since -forward-listen
+	// ":0" means the port can change on every reopen.
+	reopen := func() error {
+		listener.Close()
+
+		newListener, err := a.Connection.Listen("tcp", a.ForwardListenAddr)
+		if err != nil {
+			return fmt.Errorf("Failed to re-open remote listener: %s", err)
+		}
+
+		listener = newListener
+
+		log.Debug("Re-opened remote listener after reconnect.", "addr", listener.Addr())
+
+		go a.acceptForward(listener, func() (net.Conn, error) {
+			return net.Dial("tcp", a.ForwardTargetAddr)
+		})
+
+		return nil
+	}
+
+	addr := func() string { return listener.Addr().String() }
+
+	return a.driveRemoteForwardTraffic(addr, reopen)
+}
+
+// acceptForward relays every connection accepted on listener to a peer
+// opened by dialPeer, in both directions, until listener is closed.
+func (a *Agent) acceptForward(listener net.Listener, dialPeer func() (net.Conn, error)) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go a.relayForward(conn, dialPeer)
+	}
+}
+
+// relayForward copies bytes between conn and a peer opened by dialPeer
+// until either side closes.
+func (a *Agent) relayForward(conn net.Conn, dialPeer func() (net.Conn, error)) {
+	defer conn.Close()
+
+	peer, err := dialPeer()
+	if err != nil {
+		log.Error("Failed to dial forward peer.", "error", err)
+		return
+	}
+
+	defer peer.Close()
+
+	done := make(chan struct{}, 2)
+
+	go func() {
+		io.Copy(peer, conn)
+		done <- struct{}{}
+	}()
+
+	go func() {
+		io.Copy(conn, peer)
+		done <- struct{}{}
+	}()
+
+	<-done
+}
+
+// driveForwardTraffic repeatedly connects to addr as a synthetic client,
+// writes a random payload, and records the round trip, until the
+// connection TTL is reached.
+func (a *Agent) driveForwardTraffic(addr string) error {
+	idx := 0
+	for {
+		if a.ConnectionDeadline.Before(time.Now()) {
+			log.Info("Connection TTL reached. Closing agent...")
+			return nil
+		}
+
+		if err := a.forwardRoundWithRetry(idx, func() (int, error) {
+			return a.sendForwardPayload(addr)
+		}, nil); err != nil {
+			log.Error("Forward round-trip failed.", "error", err)
+			return err
+		}
+
+		time.Sleep(a.getSleepDuration())
+		idx++
+	}
+}
+
+// forwardRoundWithRetry runs one synthetic traffic round via roundTrip,
+// reconnecting the SSH connection and retrying on failure up to
+// a.RetryPolicy's attempt limit, the same contract RunStandardProgram
+// offers its commands. For forward-local, connections accepted on the
+// listener pick up the reconnected a.Connection automatically, since
+// dialPeer reads it fresh on every call, so reopen can be nil. For
+// forward-remote the forwarded port itself dies with the old
+// connection, so reopen must re-establish it; it's called after every
+// successful reconnect, before the next attempt.
+func (a *Agent) forwardRoundWithRetry(idx int, roundTrip func() (int, error), reopen func() error) error {
+	maxAttempts := a.RetryPolicy.attempts()
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		var n int
+		start := time.Now()
+		n, err = roundTrip()
+		exitCode := 0
+		if err != nil {
+			exitCode = -1
+		}
+
+		a.emitRecord(fmt.Sprintf("forward#%d", idx), "forward", exitCode, n, time.Since(start))
+
+		if err == nil {
+			return nil
+		}
+
+		if attempt == maxAttempts {
+			break
+		}
+
+		log.Debug("Forward round-trip failed, reconnecting.", "attempt", attempt, "error", err)
+
+		if reErr := a.reconnect(); reErr != nil {
+			return fmt.Errorf("Lost connection and failed to reconnect: %s", reErr)
+		}
+
+		if reopen != nil {
+			if reErr := reopen(); reErr != nil {
+				return fmt.Errorf("Reconnected but failed to restore the forward: %s", reErr)
+			}
+		}
+	}
+
+	return fmt.Errorf("Forward round-trip failed after %d attempt(s): %s", maxAttempts, err)
+}
+
+// sendForwardPayload dials addr directly, writes a random payload, and
+// reads back the same number of bytes. The whole round trip is bounded
+// by a.ForwardTimeout so a non-echoing -forward-target can't hang the
+// agent forever and defeat -ttl.
+func (a *Agent) sendForwardPayload(addr string) (int, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+
+	defer conn.Close()
+
+	if a.ForwardTimeout > 0 {
+		if err := conn.SetDeadline(time.Now().Add(a.ForwardTimeout)); err != nil {
+			return 0, err
+		}
+	}
+
+	payload := randomPayload(a.ForwardPayloadSize)
+	if _, err := conn.Write(payload); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, len(payload))
+
+	return io.ReadFull(conn, buf)
+}
+
+// driveRemoteForwardTraffic has the remote host connect back to its own
+// forwarded port and pipe a payload through it, so -mode forward-remote
+// generates real traffic through the tunnel without an external client.
+// addr is read fresh on every round since reopen may hand back a
+// listener on a different address.
+func (a *Agent) driveRemoteForwardTraffic(addr func() string, reopen func() error) error {
+	idx := 0
+	for {
+		if a.ConnectionDeadline.Before(time.Now()) {
+			log.Info("Connection TTL reached. Closing agent...")
+			return nil
+		}
+
+		if err := a.forwardRoundWithRetry(idx, func() (int, error) {
+			return a.remoteForwardRoundTrip(addr())
+		}, reopen); err != nil {
+			log.Error("Forward round-trip failed.", "error", err)
+			return err
+		}
+
+		time.Sleep(a.getSleepDuration())
+		idx++
+	}
+}
+
+// remoteForwardRoundTrip runs a one-shot remote command that pipes a
+// random payload of a.ForwardPayloadSize bytes into addr, as seen from
+// the server, and reports how many bytes came back through the tunnel
+// (the length of the command's output). The command is
+// bounded by a.ForwardTimeout, the same way readUntilPrompt bounds a
+// TTY prompt wait, so a -forward-target that never drains the payload
+// can't hang the agent forever and defeat -ttl.
+func (a *Agent) remoteForwardRoundTrip(addr string) (int, error) {
+	sess, err := a.Connection.NewSession()
+	if err != nil {
+		return 0, err
+	}
+
+	defer sess.Close()
+
+	cmd := fmt.Sprintf("head -c %d /dev/urandom | nc -q1 %s", a.ForwardPayloadSize, addr)
+
+	if a.ForwardTimeout <= 0 {
+		out, err := sess.Output(cmd)
+		return len(out), err
+	}
+
+	type result struct {
+		out []byte
+		err error
+	}
+
+	resultCh := make(chan result, 1)
+
+	go func() {
+		out, err := sess.Output(cmd)
+		resultCh <- result{out, err}
+	}()
+
+	select {
+	case r := <-resultCh:
+		return len(r.out), r.err
+	case <-time.After(a.ForwardTimeout):
+		sess.Close()
+		return 0, fmt.Errorf("Timed out after %s waiting for remote forward round trip", a.ForwardTimeout)
+	}
+}
+
+// randomPayload returns n random bytes to push through a forwarded
+// connection or an SFTP Put.
+func randomPayload(n int) []byte {
+	buf := make([]byte, n)
+	rand.Read(buf)
+
+	return buf
+}
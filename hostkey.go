@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultKnownHostsPath returns the known_hosts file ssh(1) itself reads
+// and writes, used when -known-hosts is left unset.
+func defaultKnownHostsPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+
+	return filepath.Join(home, ".ssh", "known_hosts")
+}
+
+// hostKeyCallback builds the ssh.HostKeyCallback this agent verifies the
+// server against. A -host-key-fingerprint pin takes precedence over
+// everything else; otherwise the server is checked against a
+// known_hosts file, falling back to TOFU (trust-on-first-use) for hosts
+// neither file has seen before if a.TOFU is set.
+func (a *Agent) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if a.HostKeyFingerprint != "" {
+		return a.pinnedHostKeyCallback(), nil
+	}
+
+	knownHostsPath := a.KnownHostsPath
+	if knownHostsPath == "" {
+		knownHostsPath = defaultKnownHostsPath()
+	}
+
+	tofuPath := a.tofuPath(knownHostsPath)
+
+	lookupPaths := []string{knownHostsPath}
+	if a.TOFU {
+		lookupPaths = append(lookupPaths, tofuPath)
+	}
+
+	base, err := knownHostsCallback(lookupPaths...)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := base(hostname, remote, key)
+		if err == nil {
+			return nil
+		}
+
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) > 0 {
+			a.emitRecord("host-key-verify", "hostkey", -1, 0, 0)
+			log.Error("Host key mismatch. Refusing to connect.", "host", a.Host, "error", err)
+			return err
+		}
+
+		if !a.TOFU {
+			a.emitRecord("host-key-verify", "hostkey", -1, 0, 0)
+			return fmt.Errorf("Host key for %s is not in %s: %s", hostname, knownHostsPath, err)
+		}
+
+		if err := appendKnownHost(tofuPath, hostname, key); err != nil {
+			a.emitRecord("host-key-verify", "hostkey", -1, 0, 0)
+			return fmt.Errorf("Failed to record new host key: %s", err)
+		}
+
+		log.Info("Trusting new host key on first use.", "host", a.Host, "fingerprint", ssh.FingerprintSHA256(key), "file", tofuPath)
+
+		return nil
+	}, nil
+}
+
+// pinnedHostKeyCallback returns a callback that only accepts a server
+// whose host key's SHA256 fingerprint matches a.HostKeyFingerprint,
+// ignoring known_hosts entirely.
+func (a *Agent) pinnedHostKeyCallback() ssh.HostKeyCallback {
+	want := normalizeFingerprint(a.HostKeyFingerprint)
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		got := normalizeFingerprint(ssh.FingerprintSHA256(key))
+		if got != want {
+			a.emitRecord("host-key-verify", "hostkey", -1, 0, 0)
+			return fmt.Errorf("Host key fingerprint mismatch for %s: got sha256:%s, want sha256:%s", hostname, got, want)
+		}
+
+		return nil
+	}
+}
+
+// normalizeFingerprint lowercases a "sha256:..." fingerprint and strips
+// its prefix, so fingerprints can be compared regardless of where they
+// came from: -host-key-fingerprint is free-form user input, while
+// ssh.FingerprintSHA256 (and tools like ssh-keygen -lf) emit "SHA256:...".
+func normalizeFingerprint(fingerprint string) string {
+	return strings.TrimPrefix(strings.ToLower(fingerprint), "sha256:")
+}
+
+// tofuPath returns the file TOFU-trusted keys are appended to. It's kept
+// separate from the user's own known_hosts file so a mob run can't
+// silently rewrite it; it defaults to a sibling "sshmob_known_hosts" file.
+func (a *Agent) tofuPath(knownHostsPath string) string {
+	if a.TOFUPath != "" {
+		return a.TOFUPath
+	}
+
+	return filepath.Join(filepath.Dir(knownHostsPath), "sshmob_known_hosts")
+}
+
+// knownHostsCallback builds a knownhosts.HostKeyCallback over the given
+// files, creating any that don't exist yet so a first run against a
+// blank slate doesn't fail outright.
+func knownHostsCallback(paths ...string) (ssh.HostKeyCallback, error) {
+	for _, p := range paths {
+		if err := ensureFile(p); err != nil {
+			return nil, fmt.Errorf("Failed to prepare known_hosts file %s: %s", p, err)
+		}
+	}
+
+	return knownhosts.New(paths...)
+}
+
+// ensureFile creates an empty file (and its parent directory) at path if
+// nothing is there yet.
+func ensureFile(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// appendKnownHost records a newly trusted host key in the given
+// known_hosts-formatted file.
+func appendKnownHost(path, hostname string, key ssh.PublicKey) error {
+	if err := ensureFile(path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{hostname}, key))
+
+	return err
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestNormalizeFingerprint(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"uppercase prefix as emitted by ssh.FingerprintSHA256", "SHA256:abcd1234", "abcd1234"},
+		{"lowercase prefix as typed by a user", "sha256:abcd1234", "abcd1234"},
+		{"mixed case prefix", "Sha256:abcd1234", "abcd1234"},
+		{"no prefix", "abcd1234", "abcd1234"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := normalizeFingerprint(c.input); got != c.want {
+				t.Errorf("normalizeFingerprint(%q) = %q, want %q", c.input, got, c.want)
+			}
+		})
+	}
+}
+
+func TestPinnedHostKeyCallback(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate test key: %s", err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("Failed to wrap test key: %s", err)
+	}
+
+	fingerprint := ssh.FingerprintSHA256(signer.PublicKey())
+
+	a := &Agent{HostKeyFingerprint: fingerprint}
+	if err := a.pinnedHostKeyCallback()("host:22", nil, signer.PublicKey()); err != nil {
+		t.Errorf("expected matching fingerprint (as emitted by ssh.FingerprintSHA256) to be accepted, got error: %s", err)
+	}
+
+	a = &Agent{HostKeyFingerprint: "sha256:" + normalizeFingerprint(fingerprint)}
+	if err := a.pinnedHostKeyCallback()("host:22", nil, signer.PublicKey()); err != nil {
+		t.Errorf("expected matching fingerprint (lowercase prefix) to be accepted, got error: %s", err)
+	}
+
+	a = &Agent{HostKeyFingerprint: "sha256:not-the-right-fingerprint"}
+	if err := a.pinnedHostKeyCallback()("host:22", nil, signer.PublicKey()); err == nil {
+		t.Errorf("expected mismatched fingerprint to be rejected")
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"fmt"
 	"math/rand"
 	"os"
+	"regexp"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/charmbracelet/huh"
 	"github.com/charmbracelet/log"
@@ -18,14 +20,64 @@ func main() {
 	username := flag.String("u", "sshmob", "Username to connect with")
 	password := flag.String("p", "", "Password to connect with")
 	count := flag.Int("count", 1, "Number of connections to make")
-	ttl := flag.Int("ttl", 60, "Time to live for each connection")
+	ttl := flag.Duration("ttl", 60*time.Second, "How long each agent's connection stays open (Go duration, e.g. 10m, 1h30m)")
+	ttlJitter := flag.Duration("ttl-jitter", 0, "Random jitter added to -ttl so agents don't all disconnect at once (disabled if 0)")
 	randomMax := flag.Int("random-max", 0, "Maximum random delay in seconds before connecting")
 	rate := flag.Int("rate", 6, "Commands per minute")
-	useTTY := flag.Bool("tty", false, "Use TTY for the connection")
+	useTTY := flag.Bool("tty", false, "Use TTY for the connection (deprecated, equivalent to -mode shell)")
+	mode := flag.String("mode", ModeExec, "Workload to run per agent: exec, shell, sftp, forward-local, forward-remote")
 	logLevel := flag.String("log-level", "info", "Log level (debug, info, warn, error)")
 	script := flag.String("script", "", "Script to run on the remote host. If a file path is provided, the contents will be used.")
+	privateKeyPath := flag.String("key", "", "Path to a private key to authenticate with")
+	passphrase := flag.String("passphrase", "", "Passphrase for the private key, if any")
+	credentialsPath := flag.String("credentials", "", "Path to a YAML/JSON file of {username,password,key,passphrase} entries to draw agent identities from")
+	credentialMode := flag.String("credential-mode", "round-robin", "How to pick a credential for each agent from -credentials (round-robin, random)")
+	promptRegex := flag.String("prompt-regex", `[\$#] ?$`, "Regex the remote shell's prompt must match before the next command is sent (TTY mode only)")
+	commandTimeout := flag.Duration("command-timeout", 10*time.Second, "How long to wait for the prompt regex to match after sending a command before giving up (TTY mode only)")
+	term := flag.String("term", "xterm-256color", "Terminal type to request for the pty (exec and shell modes)")
+	winchInterval := flag.Duration("winch-interval", 0, "Average interval between simulated terminal resizes (TTY mode only, disabled if 0)")
+	winchJitter := flag.Duration("winch-jitter", 5*time.Second, "Random jitter added to -winch-interval so agents don't resize in lockstep")
+	output := flag.String("output", "", "Where to write per-command output records (defaults to stdout)")
+	outputFormat := flag.String("output-format", "text", "Format for -output (text, json, ndjson)")
+	knownHosts := flag.String("known-hosts", "", "Path to a known_hosts file to verify server host keys against (defaults to ~/.ssh/known_hosts)")
+	hostKeyFingerprint := flag.String("host-key-fingerprint", "", "Pin the server host key to this sha256:... fingerprint instead of checking -known-hosts")
+	tofu := flag.Bool("tofu", false, "Trust-on-first-use: record host keys -known-hosts doesn't recognize to a mob-specific file instead of refusing to connect")
+	retryMaxAttempts := flag.Int("retry-max-attempts", 1, "Maximum attempts to dial or reopen a dropped session before giving up (1 disables retries)")
+	retryInitialBackoff := flag.Duration("retry-initial-backoff", 500*time.Millisecond, "Delay before the first retry")
+	retryMaxBackoff := flag.Duration("retry-max-backoff", 30*time.Second, "Upper bound a retry's backoff is capped at")
+	retryMultiplier := flag.Float64("retry-multiplier", 2, "Backoff growth factor between retries")
+	retryJitter := flag.Duration("retry-jitter", 250*time.Millisecond, "Random jitter added to each retry's backoff so a mob doesn't retry in lockstep")
+	sftpDir := flag.String("sftp-dir", ".", "Remote working directory for -mode sftp")
+	sftpMinSize := flag.Int("sftp-min-size", 1024, "Minimum random payload size in bytes for -mode sftp \"put\" operations")
+	sftpMaxSize := flag.Int("sftp-max-size", 65536, "Maximum random payload size in bytes for -mode sftp \"put\" operations")
+	sftpOps := flag.String("sftp-ops", "put,get,stat,remove", "Comma-separated cycle of operations to perform for -mode sftp")
+	forwardListen := flag.String("forward-listen", "127.0.0.1:0", "Address to listen on for -mode forward-local/forward-remote")
+	forwardTarget := flag.String("forward-target", "", "Address traffic is relayed to through the tunnel for -mode forward-local/forward-remote")
+	forwardPayloadSize := flag.Int("forward-payload-size", 4096, "Size in bytes of each synthetic payload for -mode forward-local/forward-remote")
+	forwardTimeout := flag.Duration("forward-timeout", 10*time.Second, "How long a single synthetic round trip may take for -mode forward-local/forward-remote before it's treated as a failure (0 disables the bound)")
 	flag.Parse()
 
+	resolvedMode := *mode
+	if *useTTY && resolvedMode == ModeExec {
+		resolvedMode = ModeShell
+	}
+
+	if !validModes[resolvedMode] {
+		log.Error("Unknown -mode: ", resolvedMode)
+		return
+	}
+
+	var credentialPool *CredentialPool
+	if credentialsPath != nil && *credentialsPath != "" {
+		creds, err := loadCredentials(*credentialsPath)
+		if err != nil {
+			log.Error("Failed to load credentials: ", err)
+			return
+		}
+
+		credentialPool = NewCredentialPool(creds, *credentialMode)
+	}
+
 	// If any required fields are missing, prompt the user for them
 	fields := []huh.Field{}
 	if host == nil || *host == "" {
@@ -42,7 +94,7 @@ func main() {
 		)
 	}
 
-	if username == nil || *username == "" {
+	if credentialPool == nil && (username == nil || *username == "") {
 		fields = append(fields, huh.NewInput().
 			Title("Please enter the username to connect with.").
 			Validate(func(str string) error {
@@ -56,7 +108,7 @@ func main() {
 		)
 	}
 
-	if password == nil || *password == "" {
+	if credentialPool == nil && (password == nil || *password == "") {
 		fields = append(fields, huh.NewInput().
 			Title("Please enter the password for the SSH connection.").
 			EchoMode(huh.EchoModePassword).
@@ -89,7 +141,7 @@ func main() {
 
 	log.Debug("Creating agents...")
 
-	commandScript := []string{}
+	commandScript := []ScriptStep{}
 	if script != nil && *script != "" {
 		var err error
 		commandScript, err = parseScript(*script)
@@ -99,6 +151,35 @@ func main() {
 		}
 	}
 
+	compiledPromptRegex, err := regexp.Compile(*promptRegex)
+	if err != nil {
+		log.Error("Failed to compile -prompt-regex: ", err)
+		return
+	}
+
+	sink, err := newOutputSink(*output, *outputFormat)
+	if err != nil {
+		log.Error("Failed to set up output sink: ", err)
+		return
+	}
+
+	summary := NewRunSummary()
+
+	retryPolicy := RetryPolicy{
+		MaxAttempts:    *retryMaxAttempts,
+		InitialBackoff: *retryInitialBackoff,
+		MaxBackoff:     *retryMaxBackoff,
+		Multiplier:     *retryMultiplier,
+		Jitter:         *retryJitter,
+	}
+
+	var sftpOpsList []string
+	for _, op := range strings.Split(*sftpOps, ",") {
+		if op = strings.TrimSpace(op); op != "" {
+			sftpOpsList = append(sftpOpsList, op)
+		}
+	}
+
 	for i := 0; i < *count; i++ {
 		delay := 0
 		if randomMax != nil && *randomMax > 0 {
@@ -106,15 +187,47 @@ func main() {
 		}
 
 		agents[i] = &Agent{
-			Host:            *host,
-			Port:            *port,
-			Username:        *username,
-			Password:        *password,
-			ConnectionDelay: delay,
-			ConnectionTTL:   *ttl,
-			UseTTY:          *useTTY,
-			CommandRate:     *rate,
-			CommandScript:   commandScript,
+			ID:                 i + 1,
+			Host:               *host,
+			Port:               *port,
+			Username:           *username,
+			Password:           *password,
+			PrivateKeyPath:     *privateKeyPath,
+			Passphrase:         *passphrase,
+			ConnectionDelay:    delay,
+			ConnectionTTL:      *ttl,
+			TTLJitter:          *ttlJitter,
+			Mode:               resolvedMode,
+			CommandRate:        *rate,
+			CommandScript:      commandScript,
+			PromptRegex:        compiledPromptRegex,
+			CommandTimeout:     *commandTimeout,
+			Term:               *term,
+			WindowSize:         WindowSize{Cols: 100, Rows: 30},
+			WinchInterval:      *winchInterval,
+			WinchJitter:        *winchJitter,
+			KnownHostsPath:     *knownHosts,
+			HostKeyFingerprint: *hostKeyFingerprint,
+			TOFU:               *tofu,
+			RetryPolicy:        retryPolicy,
+			SFTPDir:            *sftpDir,
+			SFTPMinSize:        *sftpMinSize,
+			SFTPMaxSize:        *sftpMaxSize,
+			SFTPOps:            sftpOpsList,
+			ForwardListenAddr:  *forwardListen,
+			ForwardTargetAddr:  *forwardTarget,
+			ForwardPayloadSize: *forwardPayloadSize,
+			ForwardTimeout:     *forwardTimeout,
+			Output:             sink,
+			Summary:            summary,
+		}
+
+		if credentialPool != nil {
+			cred := credentialPool.Next()
+			agents[i].Username = cred.Username
+			agents[i].Password = cred.Password
+			agents[i].PrivateKeyPath = cred.Key
+			agents[i].Passphrase = cred.Passphrase
 		}
 
 		wg.Add(1)
@@ -122,10 +235,18 @@ func main() {
 		log.Debug(fmt.Sprintf("Starting agent #%d", i+1))
 		go func(a *Agent) {
 			defer wg.Done()
-			agents[i].Connect()
+
+			if err := a.Connect(); err != nil {
+				log.Error("Agent failed to connect.", "agent_id", a.ID, "error", err)
+				return
+			}
 
 			log.Debug(fmt.Sprintf("Agent #%d connected. Starting command loop...", i+1))
-			agents[i].RunProgram()
+
+			if err := a.RunProgram(); err != nil {
+				log.Error("Agent command loop failed.", "agent_id", a.ID, "error", err)
+			}
+
 			a.Close()
 		}(agents[i])
 	}
@@ -134,6 +255,12 @@ func main() {
 	wg.Wait()
 
 	log.Info("All connections closed.")
+
+	summary.Log()
+
+	if err := sink.Close(); err != nil {
+		log.Error("Failed to close output sink: ", err)
+	}
 }
 
 func translateLogLevel(logLevel string) log.Level {
@@ -153,7 +280,7 @@ func translateLogLevel(logLevel string) log.Level {
 	}
 }
 
-func parseScript(script string) ([]string, error) {
+func parseScript(script string) ([]ScriptStep, error) {
 	var data []byte
 
 	// Check if the string contains a valid path
@@ -175,5 +302,10 @@ func parseScript(script string) ([]string, error) {
 		lines = strings.Split(dataStr, ";")
 	}
 
-	return lines, nil
+	steps := make([]ScriptStep, len(lines))
+	for i, line := range lines {
+		steps[i] = parseScriptLine(line)
+	}
+
+	return steps, nil
 }
@@ -0,0 +1,39 @@
+package main
+
+// Workload modes an Agent can run, selected via -mode.
+const (
+	ModeExec          = "exec"
+	ModeShell         = "shell"
+	ModeSFTP          = "sftp"
+	ModeForwardLocal  = "forward-local"
+	ModeForwardRemote = "forward-remote"
+)
+
+// validModes lists every -mode value RunProgram understands, so main can
+// reject a typo up front instead of failing deep inside an agent
+// goroutine.
+var validModes = map[string]bool{
+	ModeExec:          true,
+	ModeShell:         true,
+	ModeSFTP:          true,
+	ModeForwardLocal:  true,
+	ModeForwardRemote: true,
+}
+
+// RunProgram dispatches to the workload implementation for a.Mode. An
+// unrecognized mode (which main.go should already have rejected) falls
+// back to the exec loop.
+func (a *Agent) RunProgram() error {
+	switch a.Mode {
+	case ModeShell:
+		return a.RunTTYProgram()
+	case ModeSFTP:
+		return a.RunSFTPProgram()
+	case ModeForwardLocal:
+		return a.RunForwardLocalProgram()
+	case ModeForwardRemote:
+		return a.RunForwardRemoteProgram()
+	default:
+		return a.RunStandardProgram()
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// OutputRecord is emitted once per command an agent runs, whether over a
+// one-shot exec session or a line sent into a persistent TTY shell, and
+// also once per stderr line of a TTY shell, per SFTP operation, per
+// forward round trip, and per rejected host key.
+type OutputRecord struct {
+	AgentID   int       `json:"agent_id"`
+	Timestamp time.Time `json:"ts"`
+	Host      string    `json:"host"`
+	Command   string    `json:"command"`
+	Stream    string    `json:"stream"` // "stdout", "stderr", "sftp", "forward" or "hostkey"
+	ExitCode  int       `json:"exit_code"`
+	Bytes     int       `json:"bytes"`
+	LatencyMS int64     `json:"latency_ms"`
+}
+
+// OutputSink receives every record an agent emits. The same
+// interface backs plain text logging, structured JSON/NDJSON files, and
+// stdout, so RunTTYProgram/RunStandardProgram don't need to know which
+// one they're writing to.
+type OutputSink interface {
+	WriteRecord(OutputRecord) error
+	Close() error
+}
+
+// newOutputSink builds the sink described by -output/-output-format. An
+// empty path (or "-") writes to stdout.
+func newOutputSink(path, format string) (OutputSink, error) {
+	w := io.Writer(os.Stdout)
+	var closer io.Closer
+
+	if path != "" && path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create output file: %s", err)
+		}
+
+		w = f
+		closer = f
+	}
+
+	switch format {
+	case "json":
+		return &jsonSink{writer: w, closer: closer}, nil
+	case "ndjson":
+		return &ndjsonSink{writer: bufio.NewWriter(w), closer: closer}, nil
+	default:
+		return &textSink{writer: bufio.NewWriter(w), closer: closer}, nil
+	}
+}
+
+// textSink renders one human-readable line per record, matching the
+// "Running"/output log lines the tool already prints in debug mode.
+type textSink struct {
+	mu     sync.Mutex
+	writer *bufio.Writer
+	closer io.Closer
+}
+
+func (s *textSink) WriteRecord(r OutputRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := fmt.Fprintf(s.writer, "[agent %d] %s %s (%s, exit=%d, %dB, %dms)\n",
+		r.AgentID, r.Host, r.Command, r.Stream, r.ExitCode, r.Bytes, r.LatencyMS)
+	return err
+}
+
+func (s *textSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+
+	return nil
+}
+
+// ndjsonSink writes one JSON object per line as records arrive, so a run
+// can be tailed while it's still in progress.
+type ndjsonSink struct {
+	mu     sync.Mutex
+	writer *bufio.Writer
+	closer io.Closer
+}
+
+func (s *ndjsonSink) WriteRecord(r OutputRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.writer.Write(data); err != nil {
+		return err
+	}
+
+	return s.writer.WriteByte('\n')
+}
+
+func (s *ndjsonSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+
+	return nil
+}
+
+// jsonSink buffers every record in memory and writes a single JSON array
+// on Close, for consumers that want one well-formed document.
+type jsonSink struct {
+	mu      sync.Mutex
+	records []OutputRecord
+	writer  io.Writer
+	closer  io.Closer
+}
+
+func (s *jsonSink) WriteRecord(r OutputRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records = append(s.records, r)
+	return nil
+}
+
+func (s *jsonSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(s.records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.writer.Write(data); err != nil {
+		return err
+	}
+
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+
+	return nil
+}
+
+// latencyBucketsMS are the upper bounds (exclusive) of the run summary's
+// latency histogram, in milliseconds. The final bucket catches everything
+// slower than the last bound.
+var latencyBucketsMS = []int64{10, 50, 100, 500, 1000, 5000}
+
+// RunSummary aggregates the records from every agent in a run into
+// per-agent command/error/byte counts plus a latency histogram, printed
+// once all agents have finished.
+type RunSummary struct {
+	mu sync.Mutex
+
+	commandCounts map[int]int
+	errorCounts   map[int]int
+	byteTotals    map[int]int64
+	latencies     []int64
+}
+
+// NewRunSummary creates an empty summary ready to record from multiple
+// agents concurrently.
+func NewRunSummary() *RunSummary {
+	return &RunSummary{
+		commandCounts: map[int]int{},
+		errorCounts:   map[int]int{},
+		byteTotals:    map[int]int64{},
+	}
+}
+
+// Record folds one output record into the summary.
+func (s *RunSummary) Record(r OutputRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.commandCounts[r.AgentID]++
+	s.byteTotals[r.AgentID] += int64(r.Bytes)
+	s.latencies = append(s.latencies, r.LatencyMS)
+
+	if r.ExitCode != 0 {
+		s.errorCounts[r.AgentID]++
+	}
+}
+
+// Log writes the aggregated summary to the application logger.
+func (s *RunSummary) Log() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var totalCommands, totalErrors int
+	var totalBytes int64
+
+	for id := range s.commandCounts {
+		totalCommands += s.commandCounts[id]
+		totalErrors += s.errorCounts[id]
+		totalBytes += s.byteTotals[id]
+
+		log.Info("Agent summary",
+			"agent_id", id,
+			"commands", s.commandCounts[id],
+			"errors", s.errorCounts[id],
+			"bytes", s.byteTotals[id],
+		)
+	}
+
+	log.Info("Run summary",
+		"agents", len(s.commandCounts),
+		"commands", totalCommands,
+		"errors", totalErrors,
+		"bytes", totalBytes,
+		"latency_histogram_ms", s.histogram(),
+	)
+}
+
+// histogram buckets recorded latencies by the upper bounds in
+// latencyBucketsMS, returning a label->count map suitable for logging.
+func (s *RunSummary) histogram() map[string]int {
+	counts := make(map[string]int, len(latencyBucketsMS)+1)
+
+	for _, ms := range s.latencies {
+		idx := sort.Search(len(latencyBucketsMS), func(i int) bool { return ms < latencyBucketsMS[i] })
+
+		var label string
+		if idx == len(latencyBucketsMS) {
+			label = fmt.Sprintf(">=%dms", latencyBucketsMS[len(latencyBucketsMS)-1])
+		} else {
+			label = fmt.Sprintf("<%dms", latencyBucketsMS[idx])
+		}
+
+		counts[label]++
+	}
+
+	return counts
+}
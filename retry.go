@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how an Agent retries a failed dial or a
+// mid-run reconnect, using the same exponential-backoff-with-jitter
+// shape as most retry libraries (e.g. coder/retry): each attempt's
+// backoff is the previous one multiplied by Multiplier, capped at
+// MaxBackoff, with up to Jitter of random extra delay so a mob of
+// agents hitting the same flaky host don't all retry in lockstep.
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	Jitter         time.Duration
+}
+
+// attempts returns how many tries the policy allows. A non-positive
+// MaxAttempts is treated as "no retries" rather than "retry forever".
+func (p RetryPolicy) attempts() int {
+	if p.MaxAttempts <= 0 {
+		return 1
+	}
+
+	return p.MaxAttempts
+}
+
+// backoff returns how long to wait after the given failed attempt (1-indexed;
+// attempt 1 is the delay before the second try).
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	if p.InitialBackoff <= 0 {
+		return 0
+	}
+
+	multiplier := p.Multiplier
+	if multiplier <= 1 {
+		multiplier = 2
+	}
+
+	wait := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		wait *= multiplier
+	}
+
+	d := time.Duration(wait)
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	if p.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(p.Jitter)))
+	}
+
+	return d
+}
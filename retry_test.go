@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyAttempts(t *testing.T) {
+	cases := []struct {
+		name        string
+		maxAttempts int
+		want        int
+	}{
+		{"unset treated as single attempt", 0, 1},
+		{"negative treated as single attempt", -3, 1},
+		{"positive passed through", 5, 5},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			p := RetryPolicy{MaxAttempts: c.maxAttempts}
+			if got := p.attempts(); got != c.want {
+				t.Errorf("attempts() = %d, want %d", got, c.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     1 * time.Second,
+		Multiplier:     2,
+	}
+
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, 1 * time.Second}, // would be 1.6s uncapped; clamped to MaxBackoff
+	}
+
+	for _, c := range cases {
+		if got := p.backoff(c.attempt); got != c.want {
+			t.Errorf("backoff(%d) = %s, want %s", c.attempt, got, c.want)
+		}
+	}
+}
+
+func TestRetryPolicyBackoffDisabledWithoutInitialBackoff(t *testing.T) {
+	p := RetryPolicy{}
+	if got := p.backoff(3); got != 0 {
+		t.Errorf("backoff(3) = %s, want 0 when InitialBackoff is unset", got)
+	}
+}
+
+func TestRetryPolicyBackoffJitterStaysWithinBounds(t *testing.T) {
+	p := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		Multiplier:     2,
+		Jitter:         50 * time.Millisecond,
+	}
+
+	for i := 0; i < 20; i++ {
+		got := p.backoff(1)
+		if got < 100*time.Millisecond || got >= 150*time.Millisecond {
+			t.Fatalf("backoff(1) = %s, want within [100ms, 150ms)", got)
+		}
+	}
+}
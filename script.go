@@ -0,0 +1,31 @@
+package main
+
+import "strings"
+
+// scriptExpectDirective separates a command from an inline "@expect"
+// directive, e.g. "sudo su @expect [Pp]assword:" waits for a prompt
+// matching that regex instead of the agent's default prompt regex
+// before moving on to the next line. This lets a script step into a
+// sub-shell (sudo su, a REPL, ...) whose prompt differs from the login
+// shell's.
+const scriptExpectDirective = " @expect "
+
+// ScriptStep is a single line of a command script, with an optional
+// per-line override of the prompt regex to wait for once it's run.
+type ScriptStep struct {
+	Command     string
+	ExpectRegex string
+}
+
+// parseScriptLine splits a raw script line into its command and an
+// optional "@expect <regex>" directive.
+func parseScriptLine(line string) ScriptStep {
+	if idx := strings.Index(line, scriptExpectDirective); idx != -1 {
+		return ScriptStep{
+			Command:     line[:idx],
+			ExpectRegex: strings.TrimSpace(line[idx+len(scriptExpectDirective):]),
+		}
+	}
+
+	return ScriptStep{Command: line}
+}
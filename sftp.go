@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/pkg/sftp"
+)
+
+// defaultSFTPOps is the operation cycle used when -sftp-ops is empty.
+var defaultSFTPOps = []string{"put", "get", "stat", "remove"}
+
+// RunSFTPProgram opens an SFTP subsystem over the agent's SSH connection
+// and runs a scripted mix of Put/Get/Stat/Remove against a.SFTPDir,
+// cycling through a.SFTPOps (or defaultSFTPOps) at a.CommandRate.
+func (a *Agent) RunSFTPProgram() error {
+	if a.Connection == nil {
+		return fmt.Errorf("Connection is nil")
+	}
+
+	client, err := sftp.NewClient(a.Connection)
+	if err != nil {
+		return fmt.Errorf("Failed to start SFTP subsystem: %s", err)
+	}
+
+	// client is reassigned to a freshly reconnected one whenever
+	// runSFTPOpWithRetry reconnects, so this has to close whatever it
+	// holds when we return, not the one that existed at defer time.
+	defer func() { client.Close() }()
+
+	ops := a.SFTPOps
+	if len(ops) == 0 {
+		ops = defaultSFTPOps
+	}
+
+	var lastPath string
+
+	idx := 0
+	for {
+		if a.ConnectionDeadline.Before(time.Now()) {
+			log.Info("Connection TTL reached. Closing agent...")
+			return nil
+		}
+
+		op := ops[idx%len(ops)]
+
+		newClient, err := a.runSFTPOpWithRetry(client, op, &lastPath)
+		client = newClient
+		if err != nil {
+			log.Error("SFTP operation failed.", "op", op, "error", err)
+			return err
+		}
+
+		time.Sleep(a.getSleepDuration())
+		idx++
+	}
+}
+
+// runSFTPOpWithRetry performs one SFTP operation, reopening the SSH
+// connection and the SFTP subsystem on top of it and retrying if the op
+// fails, up to a.RetryPolicy's attempt limit. Every error is retried: a
+// failure of the operation itself is not told apart from a dropped
+// connection. It returns the
+// client to keep using afterward, which may be a freshly reconnected
+// one if a retry occurred.
+func (a *Agent) runSFTPOpWithRetry(client *sftp.Client, op string, lastPath *string) (*sftp.Client, error) {
+	maxAttempts := a.RetryPolicy.attempts()
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		log.Debug("Running SFTP op", "op", op)
+
+		var bytesMoved int
+		start := time.Now()
+		bytesMoved, err = a.runSFTPOp(client, op, lastPath)
+		exitCode := 0
+		if err != nil {
+			exitCode = -1
+		}
+
+		a.emitRecord(op, "sftp", exitCode, bytesMoved, time.Since(start))
+
+		if err == nil {
+			return client, nil
+		}
+
+		if attempt == maxAttempts {
+			break
+		}
+
+		log.Debug("SFTP op failed, reconnecting.", "op", op, "attempt", attempt, "error", err)
+
+		client.Close()
+
+		if reErr := a.reconnect(); reErr != nil {
+			return client, fmt.Errorf("Lost connection and failed to reconnect: %s", reErr)
+		}
+
+		newClient, newErr := sftp.NewClient(a.Connection)
+		if newErr != nil {
+			return client, fmt.Errorf("Failed to restart SFTP subsystem: %s", newErr)
+		}
+
+		client = newClient
+	}
+
+	return client, fmt.Errorf("SFTP op %q failed after %d attempt(s): %s", op, maxAttempts, err)
+}
+
+// runSFTPOp performs one SFTP operation against client, tracking the
+// most recently written path in lastPath so get/stat/remove have
+// something to act on.
+func (a *Agent) runSFTPOp(client *sftp.Client, op string, lastPath *string) (int, error) {
+	switch op {
+	case "put":
+		return a.sftpPut(client, lastPath)
+	case "get":
+		return a.sftpGet(client, *lastPath)
+	case "stat":
+		return a.sftpStat(client, *lastPath)
+	case "remove":
+		return a.sftpRemove(client, lastPath)
+	default:
+		return 0, fmt.Errorf("Unknown SFTP op %q", op)
+	}
+}
+
+// sftpPut writes a randomly sized payload to a new remote file under
+// a.SFTPDir and records it as lastPath for later ops.
+func (a *Agent) sftpPut(client *sftp.Client, lastPath *string) (int, error) {
+	remotePath := a.sftpRandomPath()
+
+	f, err := client.Create(remotePath)
+	if err != nil {
+		return 0, err
+	}
+
+	defer f.Close()
+
+	payload := randomPayload(a.sftpRandomSize())
+
+	n, err := f.Write(payload)
+	if err != nil {
+		return n, err
+	}
+
+	*lastPath = remotePath
+
+	return n, nil
+}
+
+// sftpGet reads lastPath back in full. A no-op (nothing to do yet)
+// returns 0 bytes moved rather than an error.
+func (a *Agent) sftpGet(client *sftp.Client, lastPath string) (int, error) {
+	if lastPath == "" {
+		return 0, nil
+	}
+
+	f, err := client.Open(lastPath)
+	if err != nil {
+		return 0, err
+	}
+
+	defer f.Close()
+
+	n, err := io.Copy(io.Discard, f)
+
+	return int(n), err
+}
+
+// sftpStat stats lastPath and reports its size as the "bytes moved" for
+// the output record.
+func (a *Agent) sftpStat(client *sftp.Client, lastPath string) (int, error) {
+	if lastPath == "" {
+		return 0, nil
+	}
+
+	info, err := client.Stat(lastPath)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(info.Size()), nil
+}
+
+// sftpRemove deletes lastPath and clears it so the next "get"/"stat" is
+// a no-op until the next "put".
+func (a *Agent) sftpRemove(client *sftp.Client, lastPath *string) (int, error) {
+	if *lastPath == "" {
+		return 0, nil
+	}
+
+	err := client.Remove(*lastPath)
+	*lastPath = ""
+
+	return 0, err
+}
+
+// sftpRandomPath builds a remote file name scoped to this agent under
+// a.SFTPDir, so concurrent agents in the same mob don't collide.
+func (a *Agent) sftpRandomPath() string {
+	return path.Join(a.SFTPDir, fmt.Sprintf("sshmob-%d-%d", a.ID, rand.Int63()))
+}
+
+// sftpRandomSize picks a payload size uniformly between a.SFTPMinSize
+// and a.SFTPMaxSize.
+func (a *Agent) sftpRandomSize() int {
+	if a.SFTPMaxSize <= a.SFTPMinSize {
+		return a.SFTPMinSize
+	}
+
+	return a.SFTPMinSize + rand.Intn(a.SFTPMaxSize-a.SFTPMinSize+1)
+}
@@ -2,78 +2,305 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"regexp"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
+// WindowSize is a terminal's dimensions in character columns and rows.
+type WindowSize struct {
+	Cols int
+	Rows int
+}
+
+// winchMsg is the RFC 4254 "window-change" request payload.
+type winchMsg struct {
+	Width       uint32
+	Height      uint32
+	PixelWidth  uint32
+	PixelHeight uint32
+}
+
 type Agent struct {
-	Host            string
-	Port            int
-	Username        string
-	Password        string
-	PrivateKeyPath  string
-	UseTTY          bool
-	Connection      *ssh.Client
-	ConnectionDelay int
-	ConnectionTTL   int
-	ConnectionStart time.Time
-	CommandRate     int
-	CommandScript   []string
-}
-
-func (a *Agent) Connect() {
+	ID                 int
+	Host               string
+	Port               int
+	Username           string
+	Password           string
+	PrivateKeyPath     string
+	Passphrase         string
+	Mode               string
+	Connection         *ssh.Client
+	ConnectionDelay    int
+	ConnectionTTL      time.Duration
+	TTLJitter          time.Duration
+	ConnectionStart    time.Time
+	ConnectionDeadline time.Time
+	RetryPolicy        RetryPolicy
+	CommandRate        int
+	CommandScript      []ScriptStep
+	PromptRegex        *regexp.Regexp
+	CommandTimeout     time.Duration
+	Term               string
+	WindowSize         WindowSize
+	WinchInterval      time.Duration
+	WinchJitter        time.Duration
+	KnownHostsPath     string
+	HostKeyFingerprint string
+	TOFU               bool
+	TOFUPath           string
+	SFTPDir            string
+	SFTPMinSize        int
+	SFTPMaxSize        int
+	SFTPOps            []string
+	ForwardListenAddr  string
+	ForwardTargetAddr  string
+	ForwardPayloadSize int
+	ForwardTimeout     time.Duration
+	Output             OutputSink
+	Summary            *RunSummary
+}
+
+// emitRecord stamps a record with this agent's ID/host and forwards it
+// to the configured output sink and run summary, if any.
+func (a *Agent) emitRecord(command, stream string, exitCode, bytes int, latency time.Duration) {
+	record := OutputRecord{
+		AgentID:   a.ID,
+		Timestamp: time.Now(),
+		Host:      a.Host,
+		Command:   command,
+		Stream:    stream,
+		ExitCode:  exitCode,
+		Bytes:     bytes,
+		LatencyMS: latency.Milliseconds(),
+	}
+
+	if a.Output != nil {
+		if err := a.Output.WriteRecord(record); err != nil {
+			log.Error("Failed to write output record.", "error", err)
+		}
+	}
+
+	if a.Summary != nil {
+		a.Summary.Record(record)
+	}
+}
+
+// Connect dials the SSH server, retrying transient dial/auth failures
+// according to a.RetryPolicy before giving up.
+func (a *Agent) Connect() error {
 	if a.Connection != nil {
-		return
+		return nil
 	}
 
 	if a.ConnectionDelay > 0 {
 		time.Sleep(time.Duration(a.ConnectionDelay) * time.Second)
+		// ConnectionDelay staggers a mob's initial connections; a
+		// mid-run reconnect() shouldn't replay it on every drop.
+		a.ConnectionDelay = 0
+	}
+
+	hostKeyCallback, err := a.hostKeyCallback()
+	if err != nil {
+		return fmt.Errorf("Failed to set up host key verification: %s", err)
 	}
 
-	// Connect to the SSH server
+	// A rejected host key won't change on a retry, so it ends the dial
+	// loop at once instead of being retried like a network error.
+	hostKeyRejected := false
+
 	config := ssh.ClientConfig{
 		User: a.Username,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(a.Password),
+		Auth: a.authMethods(),
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			err := hostKeyCallback(hostname, remote, key)
+			hostKeyRejected = err != nil
+			return err
 		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
 	}
 
-	conn, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", a.Host, a.Port), &config)
+	addr := fmt.Sprintf("%s:%d", a.Host, a.Port)
+
+	maxAttempts := a.RetryPolicy.attempts()
+
+	var conn *ssh.Client
+	tried := 0
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		tried = attempt
+		conn, err = ssh.Dial("tcp", addr, &config)
+		if err == nil {
+			break
+		}
+
+		if attempt == maxAttempts || hostKeyRejected {
+			break
+		}
+
+		wait := a.RetryPolicy.backoff(attempt)
+		log.Debug("Dial failed, retrying.", "attempt", attempt, "error", err, "wait", wait)
+		time.Sleep(wait)
+	}
+
 	if err != nil {
-		log.Error("Failed to dial: ", err)
-		return
+		return fmt.Errorf("Failed to dial after %d attempt(s): %s", tried, err)
 	}
 
 	a.ConnectionStart = time.Now()
+	a.ConnectionDeadline = a.connectionDeadline()
 	a.Connection = conn
 
-	log.Debug("Connected to SSH server.", "time", time.Now(), "host", a.Host, "port", a.Port)
+	log.Debug("Connected to SSH server.", "time", a.ConnectionStart, "host", a.Host, "port", a.Port, "deadline", a.ConnectionDeadline)
 
-	if a.UseTTY {
+	return nil
+}
 
+// connectionDeadline computes when this connection should be torn down,
+// applying TTLJitter so a mob of agents doesn't disconnect in a
+// synchronized thundering herd.
+func (a *Agent) connectionDeadline() time.Time {
+	ttl := a.ConnectionTTL
+
+	if a.TTLJitter > 0 {
+		ttl += time.Duration(rand.Int63n(int64(a.TTLJitter)))
 	}
+
+	return a.ConnectionStart.Add(ttl)
 }
 
-func (a *Agent) RunProgram() error {
-	if a.UseTTY {
-		return a.RunTTYProgram()
+// reconnect closes the current (presumably dead) connection and
+// re-establishes a fresh one using the same retry policy as the
+// initial connect, so a server-side drop mid-run doesn't kill the
+// whole agent.
+func (a *Agent) reconnect() error {
+	a.Close()
+	return a.Connect()
+}
+
+// authMethods builds the list of ssh.AuthMethod this agent will offer to
+// the server, in order of preference: an SSH agent socket (if
+// SSH_AUTH_SOCK is set), a private key (optionally passphrase
+// protected), keyboard-interactive answering every prompt with the
+// configured password, and finally plain password auth.
+func (a *Agent) authMethods() []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+
+	if sockPath := os.Getenv("SSH_AUTH_SOCK"); sockPath != "" {
+		if conn, err := net.Dial("unix", sockPath); err != nil {
+			log.Debug("Failed to connect to SSH agent socket.", "path", sockPath, "error", err)
+		} else {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	if a.PrivateKeyPath != "" {
+		if signer, err := loadPrivateKey(a.PrivateKeyPath, a.Passphrase); err != nil {
+			log.Error("Failed to load private key.", "path", a.PrivateKeyPath, "error", err)
+		} else {
+			methods = append(methods, ssh.PublicKeys(signer))
+		}
 	}
 
-	return a.RunStandardProgram()
+	if a.Password != "" {
+		methods = append(methods, ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range questions {
+				answers[i] = a.Password
+			}
+			return answers, nil
+		}))
+
+		methods = append(methods, ssh.Password(a.Password))
+	}
+
+	return methods
 }
 
+// loadPrivateKey reads and parses a private key file, decrypting it
+// with the given passphrase if it's encrypted. An empty passphrase is
+// fine for unencrypted keys.
+func loadPrivateKey(path, passphrase string) (ssh.Signer, error) {
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read private key: %s", err)
+	}
+
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	}
+
+	return ssh.ParsePrivateKey(key)
+}
+
+// permanentError marks a TTY session failure that reconnecting won't
+// fix (e.g. a malformed script), so RunTTYProgram gives up immediately
+// instead of burning through its reconnect attempts on it.
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// RunTTYProgram drives a persistent interactive shell, reopening the
+// session (and resuming the script where it left off) if the server
+// drops the connection mid-run, up to a.RetryPolicy's attempt limit.
 func (a *Agent) RunTTYProgram() error {
 	if a.Connection == nil {
 		return fmt.Errorf("Connection is nil")
 	}
 
+	idx := 0
+	maxAttempts := a.RetryPolicy.attempts()
+
+	for attempt := 1; ; attempt++ {
+		if a.ConnectionDeadline.Before(time.Now()) {
+			log.Info("Connection TTL reached. Closing agent...")
+			return nil
+		}
+
+		nextIdx, err := a.runTTYSession(idx)
+		if err == nil {
+			return nil
+		}
+
+		var permErr *permanentError
+		if errors.As(err, &permErr) {
+			return permErr.err
+		}
+
+		if attempt >= maxAttempts {
+			return fmt.Errorf("TTY session failed after %d attempt(s): %s", attempt, err)
+		}
+
+		log.Debug("TTY session dropped, reconnecting.", "attempt", attempt, "error", err)
+
+		if reErr := a.reconnect(); reErr != nil {
+			return fmt.Errorf("Lost connection and failed to reconnect: %s", reErr)
+		}
+
+		idx = nextIdx
+	}
+}
+
+// runTTYSession opens one interactive shell session and runs script
+// steps starting at idx until the script is exhausted, the TTL is
+// reached, or the session breaks. It returns the index to resume at, so
+// a caller that reconnects can continue the script instead of
+// restarting it.
+func (a *Agent) runTTYSession(idx int) (int, error) {
 	sess, err := a.Connection.NewSession()
 	if err != nil {
-		return err
+		return idx, err
 	}
 
 	defer sess.Close()
@@ -85,72 +312,150 @@ func (a *Agent) RunTTYProgram() error {
 		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
 	}
 
-	if err := sess.RequestPty("xterm-256color", 100, 30, modes); err != nil {
-		a.Close()
-		return err
+	if err := sess.RequestPty(a.Term, a.WindowSize.Cols, a.WindowSize.Rows, modes); err != nil {
+		return idx, err
 	}
 
 	stdin, err := sess.StdinPipe()
 	if err != nil {
-		a.Close()
-		return err
+		return idx, err
 	}
 
 	stdout, err := sess.StdoutPipe()
 	if err != nil {
-		a.Close()
-		return err
+		return idx, err
 	}
 
-	go func() {
-		scanner := bufio.NewScanner(stdout)
-		for scanner.Scan() {
-			scanner.Text() // Do nothing with the output
-		}
-	}()
-
 	stderr, err := sess.StderrPipe()
 	if err != nil {
-		a.Close()
-		return err
+		return idx, err
 	}
 
+	// currentCommand lets the stderr scanner below attribute a line to
+	// whichever step is in flight when it arrives, even though it's
+	// read concurrently with the stdin/stdout loop that advances idx.
+	var currentCommand atomic.Value
+	currentCommand.Store("")
+
 	go func() {
 		scanner := bufio.NewScanner(stderr)
 
 		for scanner.Scan() {
-			scanner.Text() // Do nothing with the output
+			line := scanner.Text()
+			cmd, _ := currentCommand.Load().(string)
+			a.emitRecord(cmd, "stderr", -1, len(line), 0)
 		}
 	}()
 
 	if err := sess.Shell(); err != nil {
-		a.Close()
-		return err
+		return idx, err
 	}
 
-	log.Debug("Waiting for shell to start...")
-	time.Sleep(time.Second * 10) // Wait for the shell to start
+	log.Debug("Waiting for shell to be ready...")
+	if _, err := a.readUntilPrompt(stdout, a.PromptRegex); err != nil {
+		return idx, fmt.Errorf("Shell never became ready: %s", err)
+	}
+
+	stopWinch := make(chan struct{})
+	defer close(stopWinch)
+	go a.winchLoop(sess, stopWinch)
 
-	idx := 0
 	for {
-		if a.ConnectionStart.Add(time.Duration(a.ConnectionTTL) * time.Second).Before(time.Now()) {
+		if a.ConnectionDeadline.Before(time.Now()) {
 			log.Info("Connection TTL reached. Closing agent...")
-			return nil
+			return idx, nil
 		}
 
-		command := a.getCommand(idx)
+		step := a.getCommand(idx)
+		if step.Command == "" && idx >= len(a.CommandScript) && len(a.CommandScript) > 0 {
+			log.Debug("Script exhausted. Closing agent...")
+			return idx, nil
+		}
 
-		log.Debug("Running", "CMD", command)
+		log.Debug("Running", "CMD", step.Command)
 
-		if _, err := stdin.Write([]byte(command + "\r")); err != nil {
-			return err
+		currentCommand.Store(step.Command)
+
+		start := time.Now()
+
+		if _, err := stdin.Write([]byte(step.Command + "\r")); err != nil {
+			return idx, err
 		}
 
-		time.Sleep(a.getSleepDuration())
+		promptRegex := a.PromptRegex
+		if step.ExpectRegex != "" {
+			re, err := regexp.Compile(step.ExpectRegex)
+			if err != nil {
+				return idx, &permanentError{fmt.Errorf("Invalid @expect regex %q: %s", step.ExpectRegex, err)}
+			}
+
+			promptRegex = re
+		}
+
+		output, err := a.readUntilPrompt(stdout, promptRegex)
+		if err != nil {
+			a.emitRecord(step.Command, "stdout", -1, len(output), time.Since(start))
+			return idx, fmt.Errorf("Timed out waiting for prompt after %q: %s", step.Command, err)
+		}
+
+		a.emitRecord(step.Command, "stdout", 0, len(output), time.Since(start))
+
 		idx++
 	}
 }
 
+// readUntilPrompt reads from r until promptRegex matches the
+// accumulated output, or a.CommandTimeout elapses. It returns whatever
+// was read so far either way.
+func (a *Agent) readUntilPrompt(r io.Reader, promptRegex *regexp.Regexp) (string, error) {
+	type readResult struct {
+		buf []byte
+		err error
+	}
+
+	resultCh := make(chan readResult, 1)
+
+	// partial mirrors the reader's buffer so a timeout can still return
+	// what arrived before it.
+	var partial atomic.Value
+	partial.Store("")
+
+	go func() {
+		buf := make([]byte, 0, 4096)
+		chunk := make([]byte, 256)
+
+		for {
+			n, err := r.Read(chunk)
+			if n > 0 {
+				buf = append(buf, chunk[:n]...)
+				partial.Store(string(buf))
+				if promptRegex.Match(buf) {
+					resultCh <- readResult{buf, nil}
+					return
+				}
+			}
+
+			if err != nil {
+				resultCh <- readResult{buf, err}
+				return
+			}
+		}
+	}()
+
+	select {
+	case result := <-resultCh:
+		return string(result.buf), result.err
+	case <-time.After(a.CommandTimeout):
+		out, _ := partial.Load().(string)
+		return out, fmt.Errorf("no match for prompt regex %q within %s", promptRegex.String(), a.CommandTimeout)
+	}
+}
+
+// RunStandardProgram drives one-shot exec sessions. If a command fails
+// for a reason other than a non-zero remote exit status, it's assumed
+// the connection was dropped: the agent reconnects and retries that
+// same command, up to a.RetryPolicy's attempt limit, the same contract
+// RunTTYProgram offers for its session.
 func (a *Agent) RunStandardProgram() error {
 	if a.Connection == nil {
 		return fmt.Errorf("Connection is nil")
@@ -158,57 +463,163 @@ func (a *Agent) RunStandardProgram() error {
 
 	idx := 0
 	for {
-		if a.ConnectionStart.Add(time.Duration(a.ConnectionTTL) * time.Second).Before(time.Now()) {
+		if a.ConnectionDeadline.Before(time.Now()) {
 			log.Info("Connection TTL reached. Closing agent...")
 			return nil
 		}
 
-		command := a.getCommand(idx)
-
-		sess, err := a.Connection.NewSession()
-		if err != nil {
+		if err := a.runStandardStepWithRetry(a.getCommand(idx)); err != nil {
 			return err
 		}
 
-		defer sess.Close()
+		time.Sleep(a.getSleepDuration())
+		idx++
+	}
+}
+
+// runStandardStepWithRetry runs one command, reopening the connection
+// and retrying on a dropped session up to a.RetryPolicy's attempt
+// limit. A non-zero remote exit status is not retried.
+func (a *Agent) runStandardStepWithRetry(step ScriptStep) error {
+	maxAttempts := a.RetryPolicy.attempts()
+
+	var out []byte
+	var err error
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		start := time.Now()
+		out, err = a.runStandardCommand(step)
+
+		if err == nil || isExitError(err) {
+			exitCode := exitCodeFromErr(err)
+			a.emitRecord(step.Command, "stdout", exitCode, len(out), time.Since(start))
+
+			if err != nil {
+				a.Close()
+				return err
+			}
 
-		modes := ssh.TerminalModes{
-			ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
-			ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+			log.Info(string(out))
+
+			return nil
 		}
 
-		if err := sess.RequestPty("xterm-256color", 100, 30, modes); err != nil {
-			sess.Close()
-			a.Close()
-			return err
+		a.emitRecord(step.Command, "stdout", -1, len(out), time.Since(start))
+
+		if attempt == maxAttempts {
+			break
 		}
 
-		log.Debug("Running", "CMD", command)
-		out, err := sess.Output(command)
-		if err != nil {
-			sess.Close()
+		log.Debug("Session failed, reconnecting.", "attempt", attempt, "error", err)
+
+		if reErr := a.reconnect(); reErr != nil {
 			a.Close()
-			return err
+			return fmt.Errorf("Lost connection and failed to reconnect: %s", reErr)
 		}
+	}
 
-		log.Info(string(out))
-		sess.Close()
+	a.Close()
 
-		time.Sleep(a.getSleepDuration())
-		idx++
+	return fmt.Errorf("Command failed after %d attempt(s): %s", maxAttempts, err)
+}
+
+// runStandardCommand opens a fresh session and runs one command to
+// completion.
+func (a *Agent) runStandardCommand(step ScriptStep) ([]byte, error) {
+	sess, err := a.Connection.NewSession()
+	if err != nil {
+		return nil, err
 	}
+
+	defer sess.Close()
+
+	modes := ssh.TerminalModes{
+		ssh.TTY_OP_ISPEED: 14400, // input speed = 14.4kbaud
+		ssh.TTY_OP_OSPEED: 14400, // output speed = 14.4kbaud
+	}
+
+	if err := sess.RequestPty(a.Term, a.WindowSize.Cols, a.WindowSize.Rows, modes); err != nil {
+		return nil, err
+	}
+
+	log.Debug("Running", "CMD", step.Command)
+
+	return sess.Output(step.Command)
 }
 
-func (a *Agent) getCommand(idx int) string {
+// exitCodeFromErr extracts a remote command's exit status from the error
+// returned by Session.Output/Run, if any. A nil error is exit code 0; an
+// error that isn't an *ssh.ExitError (e.g. a connection failure) has no
+// meaningful exit code, reported as -1.
+func exitCodeFromErr(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus()
+	}
+
+	return -1
+}
+
+// isExitError reports whether err is a remote non-zero exit status
+// rather than a connection-level failure.
+func isExitError(err error) bool {
+	var exitErr *ssh.ExitError
+	return errors.As(err, &exitErr)
+}
+
+func (a *Agent) getCommand(idx int) ScriptStep {
 	if len(a.CommandScript) > 0 {
 		if idx >= len(a.CommandScript) {
-			return ""
+			return ScriptStep{}
 		}
 
 		return a.CommandScript[idx]
 	}
 
-	return "echo 'Hello, world!'"
+	return ScriptStep{Command: "echo 'Hello, world!'"}
+}
+
+// winchLoop periodically sends a "window-change" request on sess with a
+// jittered resize, simulating a user dragging their terminal around.
+// It exits when stop is closed. A non-positive WinchInterval disables it.
+func (a *Agent) winchLoop(sess *ssh.Session, stop <-chan struct{}) {
+	if a.WinchInterval <= 0 {
+		return
+	}
+
+	for {
+		wait := a.WinchInterval
+		if a.WinchJitter > 0 {
+			wait += time.Duration(rand.Int63n(int64(a.WinchJitter)))
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+
+		cols := a.WindowSize.Cols + rand.Intn(21) - 10
+		rows := a.WindowSize.Rows + rand.Intn(11) - 5
+		if cols < 20 {
+			cols = 20
+		}
+		if rows < 10 {
+			rows = 10
+		}
+
+		msg := winchMsg{Width: uint32(cols), Height: uint32(rows)}
+
+		log.Debug("Sending window-change", "cols", cols, "rows", rows)
+
+		if _, err := sess.SendRequest("window-change", false, ssh.Marshal(&msg)); err != nil {
+			log.Debug("Failed to send window-change.", "error", err)
+		}
+	}
 }
 
 func (a *Agent) getSleepDuration() time.Duration {